@@ -7,21 +7,23 @@ package main // import "tailscale.com/cmd/hello"
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
-	"tailscale.com/safesocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
 	"tailscale.com/tailcfg"
 )
 
@@ -29,15 +31,101 @@ var (
 	httpAddr  = flag.String("http", ":80", "address to run an HTTP server on, or empty for none")
 	httpsAddr = flag.String("https", ":443", "address to run an HTTPS server on, or empty for none")
 	testIP    = flag.String("test-ip", "", "if non-empty, look up IP and exit before running a server")
+
+	autocertMode  = flag.Bool("autocert", false, "use golang.org/x/crypto/acme/autocert to automatically provision TLS certs, instead of the static cert/key files below")
+	autocertHosts = flag.String("autocert-hosts", "hello.ipn.dev", "comma-separated list of hostnames to obtain certs for when --autocert is set")
+	autocertCache = flag.String("autocert-cache", "/var/cache/hello-autocert", "directory to cache ACME certs in when --autocert is set")
+)
+
+// certFile and keyFile are the static TLS cert/key files used when
+// --autocert is not set, and as a fallback when it is (see tlsConfig).
+const (
+	certFile = "/etc/hello/hello.ipn.dev.crt"
+	keyFile  = "/etc/hello/hello.ipn.dev.key"
 )
 
 //go:embed hello.tmpl.html
 var embeddedTemplate string
 
+// Prometheus metrics, exposed on /metrics.
+var (
+	requestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hello_requests_total",
+		Help: "Total number of HTTP requests served.",
+	})
+	whoisLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "hello_whois_duration_seconds",
+		Help: "Latency of whois lookups against the local Tailscale daemon.",
+	})
+	whoisErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hello_whois_errors_total",
+		Help: "Total number of whois lookups that returned an error.",
+	})
+	templateErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hello_template_errors_total",
+		Help: "Total number of template render errors.",
+	})
+	httpsRedirectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hello_https_redirects_total",
+		Help: "Total number of plain HTTP requests redirected to HTTPS.",
+	})
+)
+
+// accessLogEntry is a single line of the JSON access log written to stdout.
+type accessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	RemoteIP string    `json:"remote_ip"`
+	Status   int       `json:"status"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// statusCapturingWriter wraps an http.ResponseWriter to record the status
+// code written, for access logging.
+type statusCapturingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusCapturingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// withAccessLog wraps h to count requests and write a JSON access log entry
+// to stdout for every request it serves.
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusCapturingWriter{ResponseWriter: w, status: http.StatusOK}
+		requestsTotal.Inc()
+		h.ServeHTTP(sw, r)
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		logAccess(accessLogEntry{
+			Time:     start,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			RemoteIP: ip,
+			Status:   sw.status,
+			Duration: time.Since(start).Seconds() * 1000,
+		})
+	})
+}
+
+var accessLogEnc = json.NewEncoder(os.Stdout)
+
+func logAccess(e accessLogEntry) {
+	if err := accessLogEnc.Encode(e); err != nil {
+		log.Printf("access log encode error: %v", err)
+	}
+}
+
 func main() {
 	flag.Parse()
+	whoiser = newWhoIser()
 	if *testIP != "" {
-		res, err := whoIs(*testIP)
+		res, err := whoiser.WhoIs(context.Background(), *testIP)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -53,29 +141,80 @@ func main() {
 		tmpl = template.Must(template.New("home").Parse(embeddedTemplate))
 	}
 
+	var acmeManager *autocert.Manager
+	if *autocertMode {
+		if *httpAddr == "" {
+			log.Fatalf("--autocert requires --http to be set, to serve ACME HTTP-01 challenges")
+		}
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(splitTrimmed(*autocertHosts, ",")...),
+			Cache:      autocert.DirCache(*autocertCache),
+		}
+	}
+
+	httpHandler := http.Handler(http.DefaultServeMux)
+	if acmeManager != nil {
+		// Let the ACME CA complete HTTP-01 challenges on the plain HTTP
+		// server; all other requests fall through to the normal handler.
+		httpHandler = acmeManager.HTTPHandler(http.DefaultServeMux)
+	}
+	httpHandler = withAccessLog(httpHandler)
+
 	http.HandleFunc("/", root)
+	http.Handle("/metrics", requireHTTPS(promhttp.Handler()))
 	log.Printf("Starting hello server.")
 
 	errc := make(chan error, 1)
 	if *httpAddr != "" {
 		log.Printf("running HTTP server on %s", *httpAddr)
 		go func() {
-			errc <- http.ListenAndServe(*httpAddr, nil)
+			errc <- http.ListenAndServe(*httpAddr, httpHandler)
 		}()
 	}
 	if *httpsAddr != "" {
 		log.Printf("running HTTPS server on %s", *httpsAddr)
+		ln, err := tls.Listen("tcp", *httpsAddr, tlsConfig(acmeManager))
+		if err != nil {
+			log.Fatal(err)
+		}
 		go func() {
-			errc <- http.ListenAndServeTLS(*httpsAddr,
-				"/etc/hello/hello.ipn.dev.crt",
-				"/etc/hello/hello.ipn.dev.key",
-				nil,
-			)
+			errc <- http.Serve(ln, withAccessLog(http.DefaultServeMux))
 		}()
 	}
 	log.Fatal(<-errc)
 }
 
+// tlsConfig returns the *tls.Config to serve HTTPS with. If acmeManager is
+// non-nil (--autocert was set), certs are fetched on demand from an ACME CA
+// (Let's Encrypt by default) and cached in --autocert-cache, falling back to
+// the static cert/key pair at certFile/keyFile for any hostname ACME can't
+// issue a cert for; that fallback is only installed if the static pair loads
+// when tlsConfig is called, and otherwise ACME errors are returned as is.
+// Without acmeManager the static cert/key pair is used directly.
+func tlsConfig(acmeManager *autocert.Manager) *tls.Config {
+	if acmeManager == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("loading TLS cert/key: %v", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tc := acmeManager.TLSConfig()
+	acmeGetCert := tc.GetCertificate
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		tc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c, err := acmeGetCert(hello)
+			if err != nil {
+				log.Printf("autocert: falling back to static cert for %q: %v", hello.ServerName, err)
+				return &cert, nil
+			}
+			return c, nil
+		}
+	}
+	return tc
+}
+
 func slurpHTML() string {
 	slurp, err := ioutil.ReadFile("hello.tmpl.html")
 	if err != nil {
@@ -96,21 +235,67 @@ func getTmpl() (*template.Template, error) {
 var tmpl *template.Template // not used in dev mode, initialized by main after flag parse
 
 type tmplData struct {
-	DisplayName   string // "Foo Barberson"
-	LoginName     string // "foo@bar.com"
-	ProfilePicURL string // "https://..."
-	MachineName   string // "imac5k"
-	MachineOS     string // "Linux"
-	IP            string // "100.2.3.4"
+	DisplayName   string `json:"display_name"`    // "Foo Barberson"
+	LoginName     string `json:"login_name"`      // "foo@bar.com"
+	ProfilePicURL string `json:"profile_pic_url"` // "https://..."
+	MachineName   string `json:"machine_name"`    // "imac5k"
+	MachineOS     string `json:"machine_os"`      // "Linux"
+	IP            string `json:"ip"`              // "100.2.3.4"
 }
 
-func root(w http.ResponseWriter, r *http.Request) {
+// apiResponse is the JSON representation served by root when the request
+// asks for JSON (see wantsJSON), combining the rendered tmplData with the
+// raw WhoIsResponse fields for scripting.
+type apiResponse struct {
+	tmplData
+	WhoIs *tailcfg.WhoIsResponse `json:"whois,omitempty"`
+}
+
+// wantsJSON reports whether r is asking for a JSON response instead of the
+// rendered HTML page, via either an Accept: application/json header or a
+// ?format=json query parameter.
+func wantsJSON(r *http.Request) bool {
+	if r.FormValue("format") == "json" {
+		return true
+	}
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.EqualFold(strings.TrimSpace(strings.SplitN(a, ";", 2)[0]), "application/json") {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceHTTPS redirects a plain HTTP request to the root of the HTTPS site
+// on the same host (the request's path is not kept) and reports whether it
+// did so, for handlers that must not be served in the clear when --https is
+// configured.
+func enforceHTTPS(w http.ResponseWriter, r *http.Request) (redirected bool) {
 	if r.TLS == nil && *httpsAddr != "" {
 		host := r.Host
 		if strings.Contains(r.Host, "100.101.102.103") {
 			host = "hello.ipn.dev"
 		}
+		httpsRedirectsTotal.Inc()
 		http.Redirect(w, r, "https://"+host, http.StatusFound)
+		return true
+	}
+	return false
+}
+
+// requireHTTPS wraps h so that plain HTTP requests are redirected to HTTPS
+// (via enforceHTTPS) instead of reaching h, matching root's TLS enforcement.
+func requireHTTPS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enforceHTTPS(w, r) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func root(w http.ResponseWriter, r *http.Request) {
+	if enforceHTTPS(w, r) {
 		return
 	}
 	if r.RequestURI != "/" {
@@ -124,14 +309,18 @@ func root(w http.ResponseWriter, r *http.Request) {
 	}
 	tmpl, err := getTmpl()
 	if err != nil {
+		templateErrorsTotal.Inc()
 		w.Header().Set("Content-Type", "text/plain")
 		http.Error(w, "template error: "+err.Error(), 500)
 		return
 	}
 
-	who, err := whoIs(ip)
+	whoisStart := time.Now()
+	who, err := whoiser.WhoIs(r.Context(), ip)
+	whoisLatency.Observe(time.Since(whoisStart).Seconds())
 	var data tmplData
 	if err != nil {
+		whoisErrorsTotal.Inc()
 		if devMode() {
 			log.Printf("warning: using fake data in dev mode due to whois lookup error: %v", err)
 			data = tmplData{
@@ -157,8 +346,18 @@ func root(w http.ResponseWriter, r *http.Request) {
 			IP:            ip,
 		}
 	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		e.Encode(apiResponse{tmplData: data, WhoIs: who})
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl.Execute(w, data)
+	if err := tmpl.Execute(w, data); err != nil {
+		templateErrorsTotal.Inc()
+		log.Printf("template render error: %v", err)
+	}
 }
 
 // firstLabel s up until the first period, if any.
@@ -169,47 +368,12 @@ func firstLabel(s string) string {
 	return s
 }
 
-// tsSockClient does HTTP requests to the local Tailscale daemon.
-// The hostname in the HTTP request is ignored.
-var tsSockClient = &http.Client{
-	Transport: &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
-			// a TCP server on a random port, find the random port. For HTTP connections,
-			// we don't send the token. It gets added in an HTTP Basic-Auth header.
-			if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
-				var d net.Dialer
-				return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
-			}
-			return safesocket.ConnectDefault()
-		},
-	},
-}
-
-func whoIs(ip string) (*tailcfg.WhoIsResponse, error) {
-	ctx := context.Background()
-	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/whois?ip="+url.QueryEscape(ip), nil)
-	if err != nil {
-		return nil, err
-	}
-	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
-		req.SetBasicAuth("", token)
-	}
-	res, err := tsSockClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-	slurp, _ := ioutil.ReadAll(res.Body)
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP %s: %s", res.Status, slurp)
-	}
-	r := new(tailcfg.WhoIsResponse)
-	if err := json.Unmarshal(slurp, r); err != nil {
-		if max := 200; len(slurp) > max {
-			slurp = slurp[:max]
-		}
-		return nil, fmt.Errorf("failed to parse JSON WhoIsResponse from %q", slurp)
+// splitTrimmed splits s on sep and trims surrounding whitespace from each
+// resulting element, so "a, b" and "a,b" behave the same.
+func splitTrimmed(s, sep string) []string {
+	parts := strings.Split(s, sep)
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
 	}
-	return r, nil
+	return parts
 }
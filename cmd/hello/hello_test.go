@@ -0,0 +1,40 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   bool
+	}{
+		{"no params", "/", "", false},
+		{"format=json query", "/?format=json", "", true},
+		{"format=html query", "/?format=html", "", false},
+		{"accept json", "/", "application/json", true},
+		{"accept json with charset param", "/", "application/json; charset=utf-8", true},
+		{"accept json with q param among others", "/", "text/html;q=0.9, application/json;q=0.8", true},
+		{"accept json mixed case", "/", "Application/JSON", true},
+		{"accept html only", "/", "text/html", false},
+		{"accept wildcard", "/", "*/*", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if got := wantsJSON(r); got != tt.want {
+				t.Errorf("wantsJSON() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
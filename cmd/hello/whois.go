@@ -0,0 +1,195 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+)
+
+var (
+	tsnetHostname  = flag.String("tsnet-hostname", "", "if non-empty, run hello as its own tsnet node under this hostname instead of looking up whois against a co-located tailscaled")
+	whoisCacheTTL  = flag.Duration("whois-cache-ttl", 0, "if non-zero, cache whois results for this long, keyed by remote IP")
+	whoisCacheSize = flag.Int("whois-cache-size", 4096, "maximum number of entries to keep in the whois cache when --whois-cache-ttl is set")
+)
+
+// whoiser is the WhoIser used by root and the --test-ip flag, set up by
+// newWhoIser in main after flags are parsed.
+var whoiser WhoIser
+
+// WhoIser looks up the Tailscale identity of the node behind a peer IP
+// address, as reported by a Tailscale daemon.
+type WhoIser interface {
+	WhoIs(ctx context.Context, ip string) (*tailcfg.WhoIsResponse, error)
+}
+
+// newWhoIser builds the WhoIser to use for the process, based on the
+// --tsnet-hostname and --whois-cache-ttl flags.
+func newWhoIser() WhoIser {
+	var w WhoIser = new(localSockWhoIser)
+	if *tsnetHostname != "" {
+		srv := &tsnet.Server{Hostname: *tsnetHostname}
+		if _, err := srv.Up(context.Background()); err != nil {
+			log.Fatalf("tsnet: %v", err)
+		}
+		w = &tsnetWhoIser{srv: srv}
+	}
+	if *whoisCacheTTL > 0 {
+		w = newCachingWhoIser(w, *whoisCacheTTL, *whoisCacheSize)
+	}
+	return w
+}
+
+// localSockWhoIser looks up whois information from a tailscaled running
+// locally, over the safesocket.
+type localSockWhoIser struct{}
+
+// tsSockClient does HTTP requests to the local Tailscale daemon.
+// The hostname in the HTTP request is ignored.
+var tsSockClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
+			// a TCP server on a random port, find the random port. For HTTP connections,
+			// we don't send the token. It gets added in an HTTP Basic-Auth header.
+			if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
+			}
+			return safesocket.ConnectDefault()
+		},
+	},
+}
+
+func (*localSockWhoIser) WhoIs(ctx context.Context, ip string) (*tailcfg.WhoIsResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/whois?ip="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
+		req.SetBasicAuth("", token)
+	}
+	res, err := tsSockClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	slurp, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, slurp)
+	}
+	r := new(tailcfg.WhoIsResponse)
+	if err := json.Unmarshal(slurp, r); err != nil {
+		if max := 200; len(slurp) > max {
+			slurp = slurp[:max]
+		}
+		return nil, fmt.Errorf("failed to parse JSON WhoIsResponse from %q", slurp)
+	}
+	return r, nil
+}
+
+// tsnetWhoIser looks up whois information from an embedded tsnet.Server,
+// letting hello run as a standalone Tailscale node instead of depending on
+// a co-located tailscaled.
+type tsnetWhoIser struct {
+	srv *tsnet.Server
+}
+
+func (t *tsnetWhoIser) WhoIs(ctx context.Context, ip string) (*tailcfg.WhoIsResponse, error) {
+	lc, err := t.srv.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return lc.WhoIs(ctx, ip)
+}
+
+// cachingWhoIser wraps a WhoIser with an in-memory LRU cache keyed by IP, to
+// cut localapi round trips for visitors who reload the page.
+type cachingWhoIser struct {
+	WhoIser
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	ll      *list.List // of *whoisCacheEntry, most recently used at the front
+	entries map[string]*list.Element
+}
+
+type whoisCacheEntry struct {
+	ip      string
+	res     *tailcfg.WhoIsResponse
+	expires time.Time
+}
+
+func newCachingWhoIser(w WhoIser, ttl time.Duration, maxEntries int) *cachingWhoIser {
+	return &cachingWhoIser{
+		WhoIser:    w,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (c *cachingWhoIser) WhoIs(ctx context.Context, ip string) (*tailcfg.WhoIsResponse, error) {
+	if res, ok := c.get(ip); ok {
+		return res, nil
+	}
+	res, err := c.WhoIser.WhoIs(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	c.add(ip, res)
+	return res, nil
+}
+
+func (c *cachingWhoIser) get(ip string) (*tailcfg.WhoIsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[ip]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*whoisCacheEntry)
+	if time.Now().After(e.expires) {
+		c.removeLocked(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.res, true
+}
+
+func (c *cachingWhoIser) add(ip string, res *tailcfg.WhoIsResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[ip]; ok {
+		c.removeLocked(el)
+	}
+	el := c.ll.PushFront(&whoisCacheEntry{ip: ip, res: res, expires: time.Now().Add(c.ttl)})
+	c.entries[ip] = el
+	for c.ll.Len() > c.maxEntries {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+func (c *cachingWhoIser) removeLocked(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*whoisCacheEntry).ip)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// fakeWhoIser is a WhoIser that serves canned responses and counts how many
+// times it was actually invoked, so tests can assert on cache behavior.
+type fakeWhoIser struct {
+	calls int
+	res   map[string]*tailcfg.WhoIsResponse
+}
+
+func (f *fakeWhoIser) WhoIs(ctx context.Context, ip string) (*tailcfg.WhoIsResponse, error) {
+	f.calls++
+	return f.res[ip], nil
+}
+
+func TestCachingWhoIserHit(t *testing.T) {
+	fake := &fakeWhoIser{res: map[string]*tailcfg.WhoIsResponse{"1.2.3.4": {}}}
+	c := newCachingWhoIser(fake, time.Minute, 10)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.WhoIs(ctx, "1.2.3.4"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("wrapped WhoIser called %d times, want 1 (cache hits must not re-invoke it)", fake.calls)
+	}
+}
+
+func TestCachingWhoIserExpiry(t *testing.T) {
+	fake := &fakeWhoIser{res: map[string]*tailcfg.WhoIsResponse{"1.2.3.4": {}}}
+	c := newCachingWhoIser(fake, time.Millisecond, 10)
+	ctx := context.Background()
+
+	if _, err := c.WhoIs(ctx, "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := c.WhoIs(ctx, "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.calls != 2 {
+		t.Errorf("wrapped WhoIser called %d times, want 2 (expired entry must trigger a fresh lookup)", fake.calls)
+	}
+}
+
+func TestCachingWhoIserEviction(t *testing.T) {
+	fake := &fakeWhoIser{res: map[string]*tailcfg.WhoIsResponse{
+		"1.1.1.1": {}, "2.2.2.2": {}, "3.3.3.3": {},
+	}}
+	c := newCachingWhoIser(fake, time.Minute, 2)
+	ctx := context.Background()
+
+	mustWhoIs := func(ip string) {
+		t.Helper()
+		if _, err := c.WhoIs(ctx, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustWhoIs("1.1.1.1")
+	mustWhoIs("2.2.2.2")
+	mustWhoIs("1.1.1.1") // re-touch so 2.2.2.2, not 1.1.1.1, is least-recently-used
+	mustWhoIs("3.3.3.3") // over capacity: should evict 2.2.2.2
+
+	if _, ok := c.get("2.2.2.2"); ok {
+		t.Errorf("2.2.2.2 should have been evicted as least-recently-used")
+	}
+	if _, ok := c.get("1.1.1.1"); !ok {
+		t.Errorf("1.1.1.1 should still be cached (recently touched)")
+	}
+	if _, ok := c.get("3.3.3.3"); !ok {
+		t.Errorf("3.3.3.3 should still be cached (just added)")
+	}
+	if got, want := c.ll.Len(), 2; got != want {
+		t.Errorf("cache holds %d entries, want %d (maxEntries)", got, want)
+	}
+}